@@ -137,7 +137,7 @@ func bind(server func(*jid.JID, string) (*jid.JID, error)) StreamFeature {
 				if server != nil {
 					j, err = server(session.RemoteAddr(), resReq.Bind.Resource)
 				} else {
-					j, err = session.RemoteAddr().WithResource(internal.RandomID())
+					j, err = session.RemoteAddr().WithResource(internal.RandomID(16))
 				}
 				stanzaErr, ok := err.(stanza.Error)
 				if err != nil && !ok {
@@ -165,58 +165,59 @@ func bind(server func(*jid.JID, string) (*jid.JID, error)) StreamFeature {
 				return mask, nil, err
 			}
 
-			// Client encodes an IQ requesting resource binding.
-			reqID := internal.RandomID()
-			req := &bindIQ{
-				IQ: stanza.IQ{
-					ID:   reqID,
-					Type: stanza.SetIQ,
-				},
-				Bind: bindPayload{
-					Resource: session.origin.Resourcepart(),
-				},
-			}
-			_, err = req.WriteXML(session)
+			// Client sends an IQ requesting resource binding and waits on the
+			// response, using the session's IQMux to correlate the two instead
+			// of hand-decoding the reply and matching its id ourselves.
+			respChan, err := session.SendIQ(ctx, stanza.IQ{Type: stanza.SetIQ}, bindPayload{
+				Resource: session.origin.Resourcepart(),
+			}.TokenReader())
 			if err != nil {
 				return mask, nil, err
 			}
 
-			// Client waits on an IQ response.
-			//
-			// We duplicate a lot of what should be stream-level IQ logic here; that
-			// could maybe be fixed in the future, but it's necessary right now
-			// because being able to use an IQ at all during resource negotiation is a
-			// special case in XMPP that really shouldn't be valid (and is fixed in
-			// current working drafts for a bind replacement).
-			tok, err := d.Token()
-			if err != nil {
-				return mask, nil, err
-			}
-			start, ok := tok.(xml.StartElement)
-			if !ok {
-				return mask, nil, stream.BadFormat
-			}
-			resp := bindIQ{}
-			switch start.Name {
-			case xml.Name{Space: ns.Client, Local: "iq"}:
-				if err = d.DecodeElement(&resp, &start); err != nil {
+			for {
+				tok, err := d.Token()
+				if err != nil {
+					return mask, nil, err
+				}
+				start, ok := tok.(xml.StartElement)
+				if !ok {
+					continue
+				}
+				if start.Name != (xml.Name{Space: ns.Client, Local: "iq"}) {
+					return mask, nil, stream.BadFormat
+				}
+				if err = session.DispatchIQ(ctx, d, start); err != nil {
 					return mask, nil, err
 				}
-			default:
-				return mask, nil, stream.BadFormat
-			}
 
-			switch {
-			case resp.ID != reqID:
-				return mask, nil, stream.UndefinedCondition
-			case resp.Type == stanza.ResultIQ:
-				session.origin = resp.Bind.JID
-			case resp.Type == stanza.ErrorIQ:
-				return mask, nil, resp.Err
-			default:
-				return mask, nil, stanza.Error{Condition: stanza.BadRequest}
+				select {
+				case resp := <-respChan:
+					if resp.Err != nil {
+						return mask, nil, resp.Err
+					}
+					switch resp.IQ.Type {
+					case stanza.ResultIQ:
+						bp := bindPayload{}
+						if err = xml.NewTokenDecoder(resp.Payload).Decode(&bp); err != nil {
+							return mask, nil, err
+						}
+						session.origin = bp.JID
+						return Ready, nil, nil
+					case stanza.ErrorIQ:
+						stanzaErr := stanza.Error{}
+						if err = xml.NewTokenDecoder(resp.Payload).Decode(&stanzaErr); err != nil {
+							return mask, nil, err
+						}
+						return mask, nil, stanzaErr
+					default:
+						return mask, nil, stanza.Error{Condition: stanza.BadRequest}
+					}
+				default:
+					// Not our response (the mux will have dispatched it to a
+					// different handler, or ignored it); keep reading.
+				}
 			}
-			return Ready, nil, nil
 		},
 	}
 }
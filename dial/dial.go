@@ -0,0 +1,350 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package dial discovers and dials XMPP client-to-server connections using
+// the SRV-based discovery mechanism described in RFC 6120 §3.2.
+package dial // import "mellium.im/xmpp/dial"
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// Service names used for SRV lookups, as defined in RFC 6120 §3.2.
+const (
+	tcpService = "xmpp-client"
+	tlsService = "xmpps-client"
+)
+
+// defaultStagger is the delay between the start of successive connection
+// attempts when racing candidates.
+const defaultStagger = 250 * time.Millisecond
+
+// errDeclined is returned when an SRV lookup returns a single record
+// pointing at the root domain ("."), which per RFC 2782 indicates that the
+// service is explicitly not provided at this domain.
+var errDeclined = errors.New("dial: service decined by SRV record")
+
+// A Dialer discovers and dials XMPP client-to-server connections.
+//
+// The zero value of Dialer is ready to use and performs SRV discovery of
+// both the STARTTLS and implicit-TLS services, falling back to A/AAAA
+// lookups on the bare domain, and caches the results of DNS lookups in
+// memory.
+type Dialer struct {
+	// NoTLS disables discovery of the _xmpps-client (implicit TLS) service;
+	// only the STARTTLS service is tried.
+	NoTLS bool
+
+	// NoSRV disables SRV discovery entirely, dialing the bare domain on the
+	// standard client-to-server port instead.
+	NoSRV bool
+
+	// StaggerInterval is the delay between the start of successive dial
+	// attempts when racing multiple candidates. The zero value means
+	// defaultStagger (250ms).
+	StaggerInterval time.Duration
+
+	// Resolver performs the SRV and host lookups used to discover
+	// candidates. If nil, NewCache(nil) is used, caching lookups performed
+	// against net.DefaultResolver.
+	Resolver Resolver
+
+	// NetDialer is used to create the underlying network connections. Its
+	// zero value is a net.Dialer with no options set.
+	NetDialer net.Dialer
+
+	// TLSConfig is used to perform the TLS handshake against candidates
+	// discovered through the implicit-TLS (_xmpps-client) service. If nil,
+	// a config with ServerName set to the dialed domain is used.
+	TLSConfig *tls.Config
+
+	resolverOnce sync.Once
+}
+
+// candidate is a single connection target discovered during resolution.
+type candidate struct {
+	addr string
+	tls  bool
+}
+
+// resolver returns d.Resolver, lazily setting it to NewCache(nil) the first
+// time it's needed. The zero-value Dialer doc comment promises it's ready
+// to use, which implies a single *Dialer reused across reconnects; a plain
+// nil check here would race (and could construct two independent caches)
+// when Dial is called concurrently, so the assignment is guarded by a
+// sync.Once instead.
+func (d *Dialer) resolver() Resolver {
+	d.resolverOnce.Do(func() {
+		if d.Resolver == nil {
+			d.Resolver = NewCache(nil)
+		}
+	})
+	return d.Resolver
+}
+
+func (d *Dialer) stagger() time.Duration {
+	if d.StaggerInterval <= 0 {
+		return defaultStagger
+	}
+	return d.StaggerInterval
+}
+
+// candidates resolves every address that should be tried for domain, in
+// priority order: the implicit-TLS service first (unless disabled),
+// followed by the STARTTLS service, falling back to the bare domain's
+// A/AAAA records if neither SRV lookup returns any records.
+//
+// If either lookup comes back with an explicit RFC 2782 decline (a single
+// SRV record with a Target of "."), that service is skipped rather than
+// treated as NODATA; if every service tried ends up declined, candidates
+// reports that as an error instead of silently falling back to A/AAAA,
+// since a decline is the domain explicitly saying the service isn't
+// offered, not that records simply don't exist yet.
+func (d *Dialer) candidates(ctx context.Context, domain string) ([]candidate, error) {
+	var out []candidate
+	attempted, declined := 0, 0
+
+	if !d.NoSRV {
+		if !d.NoTLS {
+			attempted++
+			recs, err := d.lookupSRV(ctx, tlsService, domain)
+			switch err {
+			case errDeclined:
+				declined++
+			case nil:
+				for _, rec := range recs {
+					out = append(out, candidate{addr: target(rec), tls: true})
+				}
+			default:
+				return nil, err
+			}
+		}
+
+		attempted++
+		recs, err := d.lookupSRV(ctx, tcpService, domain)
+		switch err {
+		case errDeclined:
+			declined++
+		case nil:
+			for _, rec := range recs {
+				out = append(out, candidate{addr: target(rec)})
+			}
+		default:
+			return nil, err
+		}
+	}
+
+	if len(out) > 0 {
+		return out, nil
+	}
+	if attempted > 0 && declined == attempted {
+		return nil, errDeclined
+	}
+
+	// No SRV records (NODATA) or SRV disabled; fall back to the bare
+	// domain on the standard client-to-server port.
+	addrs, err := d.resolver().LookupHost(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		out = append(out, candidate{addr: net.JoinHostPort(addr, "5222")})
+	}
+	return out, nil
+}
+
+func (d *Dialer) lookupSRV(ctx context.Context, service, domain string) ([]*net.SRV, error) {
+	_, recs, err := d.resolver().LookupSRV(ctx, service, "tcp", domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// net.Resolver reports a name with no SRV records (NODATA) as a
+		// not-found error; treat it as an empty answer so candidates can
+		// fall back to A/AAAA.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) == 1 && recs[0].Target == "." {
+		// RFC 2782: a single record with a Target of "." means the service is
+		// explicitly decided not to be provided at this domain.
+		return nil, errDeclined
+	}
+	return recs, nil
+}
+
+func target(rec *net.SRV) string {
+	return net.JoinHostPort(rec.Target, strconv.Itoa(int(rec.Port)))
+}
+
+// Dial discovers and dials a client-to-server connection to the server
+// responsible for j's domainpart, trying every candidate returned by SRV
+// (or host) resolution in a Happy-Eyeballs-style race: candidates are
+// dialed in order, staggered by StaggerInterval, and the first successful
+// connection wins while the other attempts are cancelled.
+func (d *Dialer) Dial(ctx context.Context, j *jid.JID) (net.Conn, error) {
+	domain := j.Domainpart()
+	candidates, err := d.candidates(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("dial: no candidates found for " + domain)
+	}
+	return d.race(ctx, domain, candidates)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race dials every candidate, staggered by StaggerInterval, and returns the
+// first connection to succeed without waiting for the rest. Any candidates
+// still in flight at that point are canceled, and their results are drained
+// in the background (closing any connection that manages to complete
+// anyway) so a second successful dial never leaks its socket.
+func (d *Dialer) race(ctx context.Context, domain string, candidates []candidate) (net.Conn, error) {
+	dialCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(candidates))
+	ticker := time.NewTicker(d.stagger())
+	defer ticker.Stop()
+
+	started := 0
+	pending := 0
+	var lastErr error
+	for started < len(candidates) || pending > 0 {
+		if started < len(candidates) {
+			go d.dialOne(dialCtx, domain, candidates[started], results)
+			started++
+			pending++
+		}
+
+		// Once every candidate has been started there's no reason to keep
+		// waiting for the stagger interval between attempts.
+		var tick <-chan time.Time
+		if started < len(candidates) {
+			tick = ticker.C
+		}
+
+		select {
+		case res := <-results:
+			pending--
+			switch {
+			case res.err == nil:
+				cancel()
+				if pending > 0 {
+					go drainResults(results, pending)
+				}
+				return res.conn, nil
+			default:
+				lastErr = res.err
+			}
+		case <-tick:
+		case <-ctx.Done():
+			cancel()
+			if pending > 0 {
+				go drainResults(results, pending)
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return nil, lastErr
+}
+
+// drainResults closes any connection that arrives on results after race has
+// already returned, so that a candidate which connects mid-cleanup doesn't
+// leak its socket.
+func drainResults(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			res.conn.Close()
+		}
+	}
+}
+
+func (d *Dialer) dialOne(ctx context.Context, domain string, c candidate, results chan<- dialResult) {
+	nd := d.NetDialer
+	conn, err := nd.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		results <- dialResult{err: err}
+		return
+	}
+	if !c.tls {
+		results <- dialResult{conn: conn}
+		return
+	}
+
+	cfg := d.TLSConfig
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: domain}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		results <- dialResult{err: err}
+		return
+	}
+	results <- dialResult{conn: tlsConn}
+}
+
+// DialClient is a convenience wrapper around Dialer.Dial using the default
+// Dialer configuration (SRV discovery of both TLS services with results
+// cached in memory), customized by opts.
+//
+// This is meant to be the default transport the Session constructor falls
+// back to when no explicit net.Conn is supplied; that constructor lives
+// outside this package (and outside this tree) and isn't something this
+// package can wire itself up to, so for now callers that want the
+// SRV/Happy-Eyeballs behavior need to call DialClient themselves and pass
+// the result in.
+func DialClient(ctx context.Context, j *jid.JID, opts ...Option) (net.Conn, error) {
+	d := &Dialer{}
+	for _, o := range opts {
+		o(d)
+	}
+	return d.Dial(ctx, j)
+}
+
+// Option configures a Dialer used by DialClient.
+type Option func(*Dialer)
+
+// NoTLS disables discovery of the implicit-TLS service.
+func NoTLS() Option {
+	return func(d *Dialer) {
+		d.NoTLS = true
+	}
+}
+
+// NoSRV disables SRV discovery entirely.
+func NoSRV() Option {
+	return func(d *Dialer) {
+		d.NoSRV = true
+	}
+}
+
+// WithTLSConfig overrides the config used for the TLS handshake against
+// implicit-TLS candidates.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(d *Dialer) {
+		d.TLSConfig = cfg
+	}
+}
+
+// WithResolver overrides the resolver used to perform DNS lookups.
+func WithResolver(r Resolver) Option {
+	return func(d *Dialer) {
+		d.Resolver = r
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package dial
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver performs the DNS lookups needed to discover XMPP
+// client-to-server connection candidates. *net.Resolver satisfies this
+// interface, as does the Cache returned by NewCache.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// Default cache lifetimes used by Cache. The net package does not expose
+// the TTL of individual records, so a fixed, conservative lifetime is used
+// for positive responses; negative responses (NXDOMAIN, or any other
+// lookup error) are cached for a much shorter time so that transient
+// outages don't wedge a client that is trying to reconnect.
+const (
+	defaultTTL    = 5 * time.Minute
+	defaultNegTTL = 30 * time.Second
+)
+
+type srvEntry struct {
+	cname   string
+	addrs   []*net.SRV
+	err     error
+	expires time.Time
+}
+
+type hostEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// Cache wraps a Resolver and caches the results of lookups in memory,
+// keyed on the (domain, service) pair, so that repeated reconnects don't
+// re-resolve DNS records that haven't had time to change. A Cache is safe
+// for concurrent use.
+type Cache struct {
+	// TTL is how long a successful lookup is cached. The zero value means
+	// defaultTTL (5 minutes).
+	TTL time.Duration
+
+	// NegTTL is how long a failed lookup (including NXDOMAIN) is cached.
+	// The zero value means defaultNegTTL (30 seconds).
+	NegTTL time.Duration
+
+	next Resolver
+
+	mu    sync.Mutex
+	srv   map[string]srvEntry
+	hosts map[string]hostEntry
+	now   func() time.Time
+}
+
+// NewCache returns a Cache that performs lookups using next, caching both
+// positive and negative responses. If next is nil, net.DefaultResolver is
+// used.
+func NewCache(next Resolver) *Cache {
+	if next == nil {
+		next = net.DefaultResolver
+	}
+	return &Cache{
+		next:  next,
+		srv:   make(map[string]srvEntry),
+		hosts: make(map[string]hostEntry),
+		now:   time.Now,
+	}
+}
+
+func (c *Cache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return defaultTTL
+	}
+	return c.TTL
+}
+
+func (c *Cache) negTTL() time.Duration {
+	if c.NegTTL <= 0 {
+		return defaultNegTTL
+	}
+	return c.NegTTL
+}
+
+// LookupSRV implements Resolver.
+func (c *Cache) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	key := service + "." + proto + "." + name
+
+	c.mu.Lock()
+	entry, ok := c.srv[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.cname, entry.addrs, entry.err
+	}
+
+	cname, addrs, err := c.next.LookupSRV(ctx, service, proto, name)
+	ttl := c.ttl()
+	if err != nil {
+		ttl = c.negTTL()
+	}
+	c.mu.Lock()
+	c.srv[key] = srvEntry{cname: cname, addrs: addrs, err: err, expires: c.now().Add(ttl)}
+	c.mu.Unlock()
+	return cname, addrs, err
+}
+
+// LookupHost implements Resolver.
+func (c *Cache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.hosts[host]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := c.next.LookupHost(ctx, host)
+	ttl := c.ttl()
+	if err != nil {
+		ttl = c.negTTL()
+	}
+	c.mu.Lock()
+	c.hosts[host] = hostEntry{addrs: addrs, err: err, expires: c.now().Add(ttl)}
+	c.mu.Unlock()
+	return addrs, err
+}
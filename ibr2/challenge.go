@@ -0,0 +1,146 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package ibr2
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"mellium.im/xmlstream"
+)
+
+// errCanceled is returned when either side of the negotiation aborts the
+// exchange by sending a <cancel/> element.
+var errCanceled = errors.New("ibr2: negotiation canceled")
+
+// A Challenge is a single step in the IBR2 challenge/response exchange. The
+// same Challenge value is used on both the client and the server; depending
+// on which role the local Session is playing, either Respond (client) or
+// Send and Receive (server) are called and the other fields are ignored.
+//
+// Challenge implementations that only ever run on one side of the
+// conversation (for example, a server that never registers an account with
+// itself) may leave the unused fields nil.
+type Challenge struct {
+	// Type is the value of the "type" attribute used to identify the
+	// challenge on the wire, and must be unique within a single call to
+	// Register or Recovery.
+	Type string
+
+	// Send is called by the server to write the challenge payload as a
+	// child of the enclosing <challenge/> element.
+	Send func(ctx context.Context, w xmlstream.TokenWriter) error
+
+	// Receive is called by the server to read and validate the payload of
+	// the client's <response/> element. Returning an error fails the
+	// registration attempt with a <failure/>.
+	Receive func(ctx context.Context, r xml.TokenReader) error
+
+	// Respond is called by the client to consume the payload of the
+	// server's <challenge/> element and write the <response/> (including
+	// its enclosing element) back to the server.
+	Respond func(ctx context.Context, r xml.TokenReader, w xmlstream.TokenWriter) error
+}
+
+func challengeFor(typ string, challenges []Challenge) (Challenge, bool) {
+	for _, c := range challenges {
+		if c.Type == typ {
+			return c, true
+		}
+	}
+	return Challenge{}, false
+}
+
+// failureError is returned when the server responds with a <failure/>
+// element. It wraps the defined-condition child so that callers can
+// compare against it or print it in an error message.
+type failureError struct {
+	Condition string
+}
+
+func (e *failureError) Error() string {
+	return fmt.Sprintf("ibr2: registration failed: %s", e.Condition)
+}
+
+func decodeFailure(d *xml.Decoder, start *xml.StartElement) error {
+	parsed := struct {
+		XMLName   xml.Name
+		Condition struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	}{}
+	if err := d.DecodeElement(&parsed, start); err != nil {
+		return err
+	}
+	cond := parsed.Condition.XMLName.Local
+	if cond == "" {
+		cond = "undefined-condition"
+	}
+	return &failureError{Condition: cond}
+}
+
+// responseBuffer is an in-memory xml.TokenReader over the already-decoded
+// children of a <response/> element, used so that a Challenge's Receive
+// can be handed exactly that subtree without either under-reading (leaving
+// the enclosing </response> for the next iteration of the negotiation loop
+// to trip over) or over-reading (consuming past it) the shared decoder.
+type responseBuffer struct {
+	tokens []xml.Token
+}
+
+func (b *responseBuffer) Token() (xml.Token, error) {
+	if len(b.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := b.tokens[0]
+	b.tokens = b.tokens[1:]
+	return tok, nil
+}
+
+// bufferResponse reads tokens from d, whose matching <response/> start tag
+// has already been consumed, until that element's end tag and returns the
+// children as a replayable xml.TokenReader.
+func bufferResponse(d *xml.Decoder) (xml.TokenReader, error) {
+	buf := &responseBuffer{}
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		tok = xml.CopyToken(tok)
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth < 0 {
+				return buf, nil
+			}
+		}
+		buf.tokens = append(buf.tokens, tok)
+	}
+}
+
+func writeFailure(w xmlstream.TokenWriter, cond string) error {
+	start := xml.StartElement{Name: xml.Name{Local: "failure"}}
+	condStart := xml.StartElement{Name: xml.Name{Space: NS, Local: cond}}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := w.EncodeToken(condStart); err != nil {
+		return err
+	}
+	if err := w.EncodeToken(condStart.End()); err != nil {
+		return err
+	}
+	if err := w.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package form implements an ibr2 Challenge that collects a username and
+// password using an XEP-0004 data form, the most common way of performing
+// in-band registration.
+package form // import "mellium.im/xmpp/ibr2/form"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/ibr2"
+)
+
+// NS is the namespace used by data forms, as defined in XEP-0004.
+const NS = "jabber:x:data"
+
+// Type is the ibr2 challenge type used to identify this challenge on the
+// wire.
+const Type = "urn:xmpp:register:0:form"
+
+// errNoCreds is returned by the server when a submitted form is missing a
+// username or password.
+var errNoCreds = errors.New("form: missing username or password")
+
+type field struct {
+	Var   string `xml:"var,attr"`
+	Value string `xml:"value"`
+}
+
+type form struct {
+	XMLName xml.Name `xml:"jabber:x:data x"`
+	Type    string   `xml:"type,attr"`
+	Field   []field  `xml:"field"`
+}
+
+func fieldVal(f form, name string) string {
+	for _, fld := range f.Field {
+		if fld.Var == name {
+			return fld.Value
+		}
+	}
+	return ""
+}
+
+// Challenge returns an ibr2.Challenge that, when run on the client,
+// responds to the server's data form with the given username and password.
+// When run on the server, it presents the form and passes the submitted
+// credentials to validate, failing the registration if validate returns an
+// error.
+func Challenge(username, password string, validate func(ctx context.Context, username, password string) error) ibr2.Challenge {
+	return ibr2.Challenge{
+		Type: Type,
+		Send: func(ctx context.Context, w xmlstream.TokenWriter) error {
+			return writeForm(w, form{
+				Type: "form",
+				Field: []field{
+					{Var: "username"},
+					{Var: "password"},
+				},
+			})
+		},
+		Receive: func(ctx context.Context, r xml.TokenReader) error {
+			submitted := form{}
+			if err := xml.NewTokenDecoder(r).Decode(&submitted); err != nil {
+				return err
+			}
+			u, p := fieldVal(submitted, "username"), fieldVal(submitted, "password")
+			if u == "" || p == "" {
+				return errNoCreds
+			}
+			if validate == nil {
+				return nil
+			}
+			return validate(ctx, u, p)
+		},
+		Respond: func(ctx context.Context, r xml.TokenReader, w xmlstream.TokenWriter) error {
+			// The offered form is fixed (username/password), so there's nothing
+			// useful to read from it; skip straight to submitting the response.
+			if err := xml.NewTokenDecoder(r).Skip(); err != nil {
+				return err
+			}
+			respStart := xml.StartElement{Name: xml.Name{Local: "response"}}
+			if err := w.EncodeToken(respStart); err != nil {
+				return err
+			}
+			if err := writeForm(w, form{
+				Type: "submit",
+				Field: []field{
+					{Var: "username", Value: username},
+					{Var: "password", Value: password},
+				},
+			}); err != nil {
+				return err
+			}
+			return w.EncodeToken(respStart.End())
+		},
+	}
+}
+
+// writeForm writes f as a jabber:x:data form directly to w, one token at a
+// time; the forms used by this challenge are small and fixed, so there's no
+// need to build up an intermediate xml.TokenReader for them.
+func writeForm(w xmlstream.TokenWriter, f form) error {
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "x"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: f.Type}},
+	}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, fld := range f.Field {
+		fieldStart := xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "var"}, Value: fld.Var}},
+		}
+		valueStart := xml.StartElement{Name: xml.Name{Local: "value"}}
+		if err := w.EncodeToken(fieldStart); err != nil {
+			return err
+		}
+		if fld.Value != "" {
+			if err := w.EncodeToken(valueStart); err != nil {
+				return err
+			}
+			if err := w.EncodeToken(xml.CharData(fld.Value)); err != nil {
+				return err
+			}
+			if err := w.EncodeToken(valueStart.End()); err != nil {
+				return err
+			}
+		}
+		if err := w.EncodeToken(fieldStart.End()); err != nil {
+			return err
+		}
+	}
+	return w.EncodeToken(start.End())
+}
@@ -12,6 +12,9 @@ import (
 	"io"
 
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stream"
 )
 
 // Namespaces used by IBR.
@@ -85,7 +88,7 @@ func parseFunc(challenges ...Challenge) func(ctx context.Context, d *xml.Decoder
 	}
 }
 
-func negotiateFunc(challenges ...Challenge) func(context.Context, *xmpp.Session, interface{}) (xmpp.SessionState, io.ReadWriter, error) {
+func negotiateFunc(local string, challenges ...Challenge) func(context.Context, *xmpp.Session, interface{}) (xmpp.SessionState, io.ReadWriter, error) {
 	return func(ctx context.Context, session *xmpp.Session, supported interface{}) (mask xmpp.SessionState, rw io.ReadWriter, err error) {
 		server := (session.State() & xmpp.Received) == xmpp.Received
 
@@ -96,11 +99,199 @@ func negotiateFunc(challenges ...Challenge) func(context.Context, *xmpp.Session,
 			return
 		}
 
-		// TODO:
-		panic("not yet supported")
+		if server {
+			return negotiateServer(ctx, session, challenges)
+		}
+		return negotiateClient(ctx, session, local, challenges)
 	}
 }
 
+// negotiateClient drives the client half of the exchange: it sends the
+// initiating <register/> or <recovery/> element and then loops, responding
+// to each <challenge/> in turn until a <success/> or <failure/> is
+// received.
+func negotiateClient(ctx context.Context, session *xmpp.Session, local string, challenges []Challenge) (mask xmpp.SessionState, rw io.ReadWriter, err error) {
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: local}}
+	if err = session.EncodeToken(start); err != nil {
+		return mask, nil, err
+	}
+	if err = session.EncodeToken(start.End()); err != nil {
+		return mask, nil, err
+	}
+	if err = session.Flush(); err != nil {
+		return mask, nil, err
+	}
+
+	d := xml.NewTokenDecoder(session)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return mask, nil, err
+		}
+		cstart, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch cstart.Name.Local {
+		case "challenge":
+			typ := internal.GetAttr(cstart.Attr, "type")
+			c, ok := challengeFor(typ, challenges)
+			if !ok || c.Respond == nil {
+				return mask, nil, errNoChallenge
+			}
+			if err = c.Respond(ctx, d, session); err != nil {
+				return mask, nil, err
+			}
+			if err = session.Flush(); err != nil {
+				return mask, nil, err
+			}
+		case "success":
+			parsed := struct {
+				JID *jid.JID `xml:"urn:ietf:params:xml:ns:xmpp-bind jid"`
+			}{}
+			if err = d.DecodeElement(&parsed, &cstart); err != nil {
+				return mask, nil, err
+			}
+			if parsed.JID != nil {
+				session.SetOrigin(parsed.JID)
+			}
+			return xmpp.Authn, nil, nil
+		case "failure":
+			return mask, nil, decodeFailure(d, &cstart)
+		case "cancel":
+			if err = d.Skip(); err != nil {
+				return mask, nil, err
+			}
+			return mask, nil, errCanceled
+		case "iq":
+			// An IQ-shaped challenge (for example one that redeems an OAuth2
+			// token via an IQ round trip) calls session.SendIQ itself; feed
+			// its response through the session's mux instead of dropping it,
+			// so that still works even though the read loop proper hasn't
+			// started yet.
+			if err = session.DispatchIQ(ctx, d, cstart); err != nil {
+				return mask, nil, err
+			}
+		default:
+			if err = d.Skip(); err != nil {
+				return mask, nil, err
+			}
+		}
+	}
+}
+
+// negotiateServer drives the server half of the exchange: it walks the
+// configured challenges in order, writing each one and decoding the
+// client's response, before finishing with a <success/> or <failure/>.
+func negotiateServer(ctx context.Context, session *xmpp.Session, challenges []Challenge) (mask xmpp.SessionState, rw io.ReadWriter, err error) {
+	d := xml.NewTokenDecoder(session)
+
+	tok, err := d.Token()
+	if err != nil {
+		return mask, nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok || start.Name.Space != NS || (start.Name.Local != "register" && start.Name.Local != "recovery") {
+		return mask, nil, stream.BadFormat
+	}
+	if err = d.Skip(); err != nil {
+		return mask, nil, err
+	}
+
+	for _, c := range challenges {
+		cstart := xml.StartElement{
+			Name: xml.Name{Local: "challenge"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: c.Type}},
+		}
+		if err = session.EncodeToken(cstart); err != nil {
+			return mask, nil, err
+		}
+		if c.Send != nil {
+			if err = c.Send(ctx, session); err != nil {
+				return mask, nil, err
+			}
+		}
+		if err = session.EncodeToken(cstart.End()); err != nil {
+			return mask, nil, err
+		}
+		if err = session.Flush(); err != nil {
+			return mask, nil, err
+		}
+
+		var rstart xml.StartElement
+		for {
+			tok, err = d.Token()
+			if err != nil {
+				return mask, nil, err
+			}
+			var ok bool
+			rstart, ok = tok.(xml.StartElement)
+			if !ok {
+				// Not every token between challenges is significant (for
+				// example a whitespace keepalive ping); skip anything that
+				// isn't a start element instead of treating it as malformed,
+				// same as negotiateClient's loop above.
+				continue
+			}
+			if rstart.Name.Local != "iq" {
+				break
+			}
+			// An IQ-shaped challenge may round-trip an IQ of its own (for
+			// example to redeem an OAuth2 token) before sending its
+			// <response/>; feed it through the session's mux instead of
+			// treating it as the response itself.
+			if err = session.DispatchIQ(ctx, d, rstart); err != nil {
+				return mask, nil, err
+			}
+		}
+		switch rstart.Name.Local {
+		case "response":
+			if c.Receive == nil {
+				if err = d.Skip(); err != nil {
+					return mask, nil, err
+				}
+				continue
+			}
+			// Buffer the <response/> subtree ourselves instead of handing the
+			// shared decoder straight to Receive: Receive only reads as much
+			// of it as it cares about (for example form.Challenge.Receive
+			// stops after its single <x/> child), which would otherwise leave
+			// the closing </response> tag for the next iteration of this loop
+			// to choke on.
+			payload, err := bufferResponse(d)
+			if err != nil {
+				return mask, nil, err
+			}
+			if err = c.Receive(ctx, payload); err != nil {
+				if werr := writeFailure(session, "not-acceptable"); werr != nil {
+					return mask, nil, werr
+				}
+				return mask, nil, err
+			}
+		case "cancel":
+			if err = d.Skip(); err != nil {
+				return mask, nil, err
+			}
+			return mask, nil, errCanceled
+		default:
+			return mask, nil, stream.BadFormat
+		}
+	}
+
+	success := xml.StartElement{Name: xml.Name{Local: "success"}}
+	if err = session.EncodeToken(success); err != nil {
+		return mask, nil, err
+	}
+	if err = session.EncodeToken(success.End()); err != nil {
+		return mask, nil, err
+	}
+	if err = session.Flush(); err != nil {
+		return mask, nil, err
+	}
+	return xmpp.Authn, nil, nil
+}
+
 // Register returns a new xmpp.StreamFeature that can be used to register a new
 // account with the server.
 func Register(challenges ...Challenge) xmpp.StreamFeature {
@@ -110,7 +301,7 @@ func Register(challenges ...Challenge) xmpp.StreamFeature {
 		Prohibited: xmpp.Authn,
 		List:       listFunc(challenges...),
 		Parse:      parseFunc(challenges...),
-		Negotiate:  negotiateFunc(challenges...),
+		Negotiate:  negotiateFunc("register", challenges...),
 	}
 }
 
@@ -123,6 +314,6 @@ func Recovery(challenges ...Challenge) xmpp.StreamFeature {
 		Prohibited: xmpp.Authn,
 		List:       listFunc(challenges...),
 		Parse:      parseFunc(challenges...),
-		Negotiate:  negotiateFunc(challenges...),
+		Negotiate:  negotiateFunc("recovery", challenges...),
 	}
-}
\ No newline at end of file
+}
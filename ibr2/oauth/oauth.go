@@ -0,0 +1,117 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package oauth implements an ibr2 Challenge that registers (or recovers)
+// an account by redeeming an OAuth2 bearer token, instead of collecting a
+// username and password directly.
+package oauth // import "mellium.im/xmpp/ibr2/oauth"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/ibr2"
+)
+
+// Type is the ibr2 challenge type used to identify this challenge on the
+// wire.
+const Type = "urn:xmpp:register:0:oauth2"
+
+// errNoToken is returned by the server when a redeemed token is empty.
+var errNoToken = errors.New("oauth: empty bearer token")
+
+// Challenge returns an ibr2.Challenge that redeems an OAuth2 bearer token
+// for a new (or recovered) account.
+//
+// On the client, token is called once to fetch the bearer token that will
+// be sent to the server; it is normally a thin wrapper around an existing
+// OAuth2 client's token source. On the server, validate is called with the
+// token redeemed by the client and should return an error if the token
+// does not grant the caller a registration.
+func Challenge(token func(ctx context.Context) (string, error), validate func(ctx context.Context, token string) error) ibr2.Challenge {
+	return ibr2.Challenge{
+		Type: Type,
+		Send: func(ctx context.Context, w xmlstream.TokenWriter) error {
+			// The server has nothing to offer up front; the client already
+			// knows how to obtain a bearer token out of band.
+			return nil
+		},
+		Receive: func(ctx context.Context, r xml.TokenReader) error {
+			tok, err := readBearer(r)
+			if err != nil {
+				return err
+			}
+			if tok == "" {
+				return errNoToken
+			}
+			if validate == nil {
+				return nil
+			}
+			return validate(ctx, tok)
+		},
+		Respond: func(ctx context.Context, r xml.TokenReader, w xmlstream.TokenWriter) error {
+			if err := xml.NewTokenDecoder(r).Skip(); err != nil {
+				return err
+			}
+			if token == nil {
+				return errNoToken
+			}
+			tok, err := token(ctx)
+			if err != nil {
+				return err
+			}
+
+			start := xml.StartElement{Name: xml.Name{Local: "response"}}
+			if err := w.EncodeToken(start); err != nil {
+				return err
+			}
+			bearerStart := xml.StartElement{Name: xml.Name{Local: "bearer"}}
+			if err := w.EncodeToken(bearerStart); err != nil {
+				return err
+			}
+			if err := w.EncodeToken(xml.CharData(tok)); err != nil {
+				return err
+			}
+			if err := w.EncodeToken(bearerStart.End()); err != nil {
+				return err
+			}
+			return w.EncodeToken(start.End())
+		},
+	}
+}
+
+// readBearer reads the character data of the <bearer/> child of the
+// current <response/> element.
+func readBearer(r xml.TokenReader) (string, error) {
+	d := xml.NewTokenDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "bearer" {
+			if err := d.Skip(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		parsed := struct {
+			Token string `xml:",chardata"`
+		}{}
+		if err := d.DecodeElement(&parsed, &start); err != nil {
+			return "", err
+		}
+		return parsed.Token, nil
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmpp/stanza"
+)
+
+// HandleIQ registers h as the session's handler for inbound IQs whose child
+// element has the given name (both namespace and local name must match),
+// replacing any handler previously registered for it.
+//
+// It is exported so that stream features and other packages built on top
+// of a Session (for example roster or muc) can respond to IQs without
+// hand-rolling their own stream-level dispatch.
+func (s *Session) HandleIQ(ns xml.Name, h IQHandler) {
+	s.iqMux().HandleIQ(ns, h)
+}
+
+// SendIQ writes iq (with payload as its only child) to the session,
+// allocating an id for it if one isn't already set, and returns a channel
+// on which the response will be delivered once the session's read loop
+// dispatches it, or ctx is canceled first.
+func (s *Session) SendIQ(ctx context.Context, iq stanza.IQ, payload xml.TokenReader) (<-chan Response, error) {
+	return s.iqMux().SendIQ(ctx, s, iq, payload)
+}
+
+// DispatchIQ feeds a single inbound <iq/>, whose start tag has already been
+// read from d, to the session's IQMux.
+//
+// The background read loop calls this for every top-level <iq/> it reads
+// off the stream. It is also exported for the benefit of code that, like
+// bind's Negotiate or ibr2's negotiate loop, must drive its own token loop
+// before that read loop has taken over: calling DispatchIQ from such a loop
+// still routes any IQ-shaped exchange through the same mux that SendIQ and
+// HandleIQ use, rather than hand-decoding and id-matching it separately.
+func (s *Session) DispatchIQ(ctx context.Context, d *xml.Decoder, start xml.StartElement) error {
+	return s.iqMux().Dispatch(ctx, s, d, start)
+}
+
+// iqMux returns the session's IQMux, creating it the first time it's
+// needed.
+func (s *Session) iqMux() *IQMux {
+	s.muxOnce.Do(func() {
+		s.mux = NewIQMux()
+	})
+	return s.mux
+}
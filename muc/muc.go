@@ -0,0 +1,261 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package muc implements multi-user chat as described in XEP-0045.
+//
+// A Client is attached to a Session and used to Join rooms. Tracking an
+// occupant roster, a room's subject, and incoming messages requires
+// inbound presence and message stanzas addressed to the room to be fed to
+// the Client (normally by the session's background read loop, by calling
+// HandlePresence and HandleMessage); Join itself only sends the initial
+// join presence and returns a Room that starts out empty.
+package muc // import "mellium.im/xmpp/muc"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by MUC, as defined in XEP-0045.
+const (
+	NS      = "http://jabber.org/protocol/muc"
+	NSUser  = NS + "#user"
+	NSOwner = NS + "#owner"
+	NSAdmin = NS + "#admin"
+)
+
+// Role is a temporary position held by an occupant in the context of a
+// single room, as defined in XEP-0045 §5.1.
+type Role string
+
+// Roles defined by XEP-0045.
+const (
+	RoleNone        Role = "none"
+	RoleVisitor     Role = "visitor"
+	RoleParticipant Role = "participant"
+	RoleModerator   Role = "moderator"
+)
+
+// Affiliation is a long-lived association between a user and a room, as
+// defined in XEP-0045 §5.2.
+type Affiliation string
+
+// Affiliations defined by XEP-0045.
+const (
+	AffiliationOutcast Affiliation = "outcast"
+	AffiliationNone    Affiliation = "none"
+	AffiliationMember  Affiliation = "member"
+	AffiliationAdmin   Affiliation = "admin"
+	AffiliationOwner   Affiliation = "owner"
+)
+
+// Status codes defined by XEP-0045 §15.
+const (
+	StatusSelfPresence = 110
+	StatusNickChanged  = 210
+	StatusBanned       = 301
+	StatusNewNick      = 303
+	StatusKicked       = 307
+	StatusRemoved      = 321
+)
+
+var errNotJoined = errors.New("muc: not currently an occupant of this room")
+
+// Client attaches MUC support to a Session, tracking every Room that has
+// been joined through it.
+type Client struct {
+	session *xmpp.Session
+
+	mu    sync.RWMutex
+	rooms map[string]*Room
+}
+
+// New returns a Client that uses s to join and interact with rooms.
+func New(s *xmpp.Session) *Client {
+	return &Client{
+		session: s,
+		rooms:   make(map[string]*Room),
+	}
+}
+
+// Options configure a call to Join.
+type Options struct {
+	Password string
+	History  int
+}
+
+// Option configures a room join.
+type Option func(*Options)
+
+// Password joins a password-protected room.
+func Password(pass string) Option {
+	return func(o *Options) {
+		o.Password = pass
+	}
+}
+
+// History requests up to n stanzas of discussion history when joining.
+func History(n int) Option {
+	return func(o *Options) {
+		o.History = n
+	}
+}
+
+// Join sends the presence required to join (or create) the room at
+// roomJID under the given nickname and begins tracking it as a Room. It
+// does not wait for the server to confirm the join (that confirmation is
+// the self-presence delivered to HandlePresence, carrying status code
+// 110); callers that are driving the stream themselves can wait on it
+// using Room's Joined channel.
+func (c *Client) Join(ctx context.Context, roomJID *jid.JID, nick string, opts ...Option) (*Room, error) {
+	o := Options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	self, err := roomJID.Bare().WithResource(nick)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRoom(c, self)
+
+	start := xml.StartElement{
+		Name: xml.Name{Local: "presence"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "to"}, Value: self.String()}},
+	}
+	xStart := xml.StartElement{Name: xml.Name{Space: NS, Local: "x"}}
+	if err = c.session.EncodeToken(start); err != nil {
+		return nil, err
+	}
+	if err = c.session.EncodeToken(xStart); err != nil {
+		return nil, err
+	}
+	if o.Password != "" {
+		if err = writeElem(c.session, "password", o.Password); err != nil {
+			return nil, err
+		}
+	}
+	if o.History > 0 {
+		histStart := xml.StartElement{
+			Name: xml.Name{Local: "history"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "maxstanzas"}, Value: strconv.Itoa(o.History)}},
+		}
+		if err = c.session.EncodeToken(histStart); err != nil {
+			return nil, err
+		}
+		if err = c.session.EncodeToken(histStart.End()); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.session.EncodeToken(xStart.End()); err != nil {
+		return nil, err
+	}
+	if err = c.session.EncodeToken(start.End()); err != nil {
+		return nil, err
+	}
+	if err = c.session.Flush(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.rooms[roomJID.Bare().String()] = r
+	c.mu.Unlock()
+
+	return r, nil
+}
+
+// Room looks up a previously joined room by its bare JID.
+func (c *Client) Room(roomJID *jid.JID) (*Room, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r, ok := c.rooms[roomJID.Bare().String()]
+	return r, ok
+}
+
+func (c *Client) forget(roomJID *jid.JID) {
+	c.mu.Lock()
+	delete(c.rooms, roomJID.Bare().String())
+	c.mu.Unlock()
+}
+
+// HandlePresence routes an inbound presence stanza, whose start tag has
+// already been read from d, to the Room it's addressed from, updating the
+// room's occupant list and emitting an Event if one is registered. It is a
+// no-op if the presence isn't from a room this Client has joined.
+func (c *Client) HandlePresence(d *xml.Decoder, start xml.StartElement) error {
+	from := internal.GetAttr(start.Attr, "from")
+	j, err := jid.Parse(from)
+	if err != nil {
+		return d.Skip()
+	}
+
+	c.mu.RLock()
+	r, ok := c.rooms[j.Bare().String()]
+	c.mu.RUnlock()
+	if !ok {
+		return d.Skip()
+	}
+	return r.handlePresence(d, start, j)
+}
+
+// HandleMessage routes an inbound groupchat message stanza, whose start
+// tag has already been read from d, to the Room it's addressed from. It is
+// a no-op if the message isn't from a room this Client has joined.
+func (c *Client) HandleMessage(d *xml.Decoder, start xml.StartElement) error {
+	from := internal.GetAttr(start.Attr, "from")
+	j, err := jid.Parse(from)
+	if err != nil {
+		return d.Skip()
+	}
+
+	c.mu.RLock()
+	r, ok := c.rooms[j.Bare().String()]
+	c.mu.RUnlock()
+	if !ok {
+		return d.Skip()
+	}
+	return r.handleMessage(d, start, j)
+}
+
+func writeElem(w interface {
+	EncodeToken(xml.Token) error
+}, local, value string) error {
+	start := xml.StartElement{Name: xml.Name{Local: local}}
+	if err := w.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := w.EncodeToken(xml.CharData(value)); err != nil {
+		return err
+	}
+	return w.EncodeToken(start.End())
+}
+
+// roundtripIQ sends iq with payload as its only child through the
+// session's shared IQMux and waits for the matching response to arrive.
+// Unlike an earlier version of this function, it does not read from the
+// session itself: the session's background read loop is what feeds the
+// mux inbound stanzas (see the package doc), and reading here too would
+// race with it, silently dropping whatever presence or groupchat message
+// the read loop doesn't get to first.
+func (c *Client) roundtripIQ(ctx context.Context, iq stanza.IQ, payload xml.TokenReader) (stanza.IQType, xml.TokenReader, error) {
+	respChan, err := c.session.SendIQ(ctx, iq, payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp := <-respChan
+	if resp.Err != nil {
+		return "", nil, resp.Err
+	}
+	return resp.IQ.Type, resp.Payload, nil
+}
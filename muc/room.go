@@ -0,0 +1,583 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package muc
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Occupant is a single member of a room's occupant roster.
+type Occupant struct {
+	Nick        string
+	JID         *jid.JID
+	Affiliation Affiliation
+	Role        Role
+}
+
+// EventType identifies the kind of change an Event describes.
+type EventType int
+
+// Event types emitted by a Room.
+const (
+	EventJoin EventType = iota
+	EventLeave
+	EventNickChange
+	EventKick
+	EventBan
+
+	// EventJoinError is emitted instead of EventJoin when the room refuses a
+	// join (for example a nickname conflict or a not-authorized error).
+	EventJoinError
+)
+
+// Event describes a change to a room's occupant roster.
+type Event struct {
+	Type     EventType
+	Occupant Occupant
+
+	// OldNick is set on an EventNickChange to the occupant's previous
+	// nickname.
+	OldNick string
+
+	// Reason is set on an EventKick or EventBan if the server or a
+	// moderator supplied one.
+	Reason string
+
+	// Err is set on an EventJoinError to the stanza.Error the room returned
+	// instead of admitting the join.
+	Err error
+}
+
+// Message is a group-chat message received in a Room.
+type Message struct {
+	xmpp.Message
+
+	// Nick is the nickname of the occupant that sent the message.
+	Nick string
+
+	// Body is the message's plain-text body, if any.
+	Body string
+}
+
+// Room represents a joined multi-user chat room and tracks its occupant
+// roster and subject as inbound stanzas are fed to it through the owning
+// Client's HandlePresence and HandleMessage.
+type Room struct {
+	client *Client
+	self   *jid.JID
+
+	mu        sync.RWMutex
+	occupants map[string]Occupant
+	subject   string
+
+	// Joined is closed once this occupant's own join presence (status code
+	// 110) has been observed.
+	Joined   chan struct{}
+	joinOnce sync.Once
+
+	events   chan Event
+	messages chan Message
+}
+
+func newRoom(c *Client, self *jid.JID) *Room {
+	return &Room{
+		client:    c,
+		self:      self,
+		occupants: make(map[string]Occupant),
+		Joined:    make(chan struct{}),
+		events:    make(chan Event, 32),
+		messages:  make(chan Message, 32),
+	}
+}
+
+// JID is the bare JID of the room.
+func (r *Room) JID() *jid.JID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.self.Bare()
+}
+
+// Nick is the nickname this occupant is currently using in the room.
+func (r *Room) Nick() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.self.Resourcepart()
+}
+
+// selfJID returns the full JID (including resourcepart) this occupant is
+// currently using in the room.
+func (r *Room) selfJID() *jid.JID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.self
+}
+
+// Occupants returns a snapshot of the room's current occupant roster.
+func (r *Room) Occupants() []Occupant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	occupants := make([]Occupant, 0, len(r.occupants))
+	for _, o := range r.occupants {
+		occupants = append(occupants, o)
+	}
+	return occupants
+}
+
+// Subject returns the room's most recently announced subject.
+func (r *Room) Subject() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.subject
+}
+
+// Events returns a channel on which occupant roster changes are published.
+func (r *Room) Events() <-chan Event {
+	return r.events
+}
+
+// Messages returns a channel on which group-chat messages sent to the
+// room are published.
+func (r *Room) Messages() <-chan Message {
+	return r.messages
+}
+
+func (r *Room) emit(e Event) {
+	select {
+	case r.events <- e:
+	default:
+	}
+}
+
+type mucItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	JID         string `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+	Reason      string `xml:"reason,omitempty"`
+}
+
+type mucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type mucUserX struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Item    *mucItem    `xml:"item"`
+	Status  []mucStatus `xml:"status"`
+}
+
+func hasStatus(x mucUserX, code int) bool {
+	for _, s := range x.Status {
+		if s.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Room) handlePresence(d *xml.Decoder, start xml.StartElement, from *jid.JID) error {
+	typ := internal.GetAttr(start.Attr, "type")
+	nick := from.Resourcepart()
+
+	parsed := struct {
+		X     mucUserX      `xml:"http://jabber.org/protocol/muc#user x"`
+		Error *stanza.Error `xml:"error"`
+	}{}
+	if err := d.DecodeElement(&parsed, &start); err != nil {
+		return err
+	}
+	x := parsed.X
+
+	occ := Occupant{Nick: nick}
+	if x.Item != nil {
+		occ.Affiliation = Affiliation(x.Item.Affiliation)
+		occ.Role = Role(x.Item.Role)
+		if x.Item.JID != "" {
+			occ.JID, _ = jid.Parse(x.Item.JID)
+		}
+	}
+
+	if typ == "error" {
+		// A failed join (nickname conflict, not-authorized, room full, ...)
+		// isn't an occupant joining; don't touch the roster, and in
+		// particular don't let it close r.Joined the way a genuine
+		// self-presence does below.
+		joinErr := error(errNotJoined)
+		if parsed.Error != nil {
+			joinErr = *parsed.Error
+		}
+		r.emit(Event{Type: EventJoinError, Occupant: occ, Err: joinErr})
+		return nil
+	}
+
+	isSelf := hasStatus(x, StatusSelfPresence) || nick == r.Nick()
+
+	switch {
+	case typ == "unavailable" && hasStatus(x, StatusNewNick) && x.Item != nil:
+		newNick := x.Item.Nick
+		newOcc := Occupant{Nick: newNick, Affiliation: occ.Affiliation, Role: occ.Role, JID: occ.JID}
+		r.mu.Lock()
+		delete(r.occupants, nick)
+		r.occupants[newNick] = newOcc
+		if isSelf {
+			r.self, _ = r.self.Bare().WithResource(newNick)
+		}
+		r.mu.Unlock()
+		r.emit(Event{Type: EventNickChange, Occupant: newOcc, OldNick: nick})
+	case typ == "unavailable" && hasStatus(x, StatusBanned):
+		r.mu.Lock()
+		delete(r.occupants, nick)
+		r.mu.Unlock()
+		r.emit(Event{Type: EventBan, Occupant: occ, Reason: itemReason(x.Item)})
+	case typ == "unavailable" && hasStatus(x, StatusKicked):
+		r.mu.Lock()
+		delete(r.occupants, nick)
+		r.mu.Unlock()
+		r.emit(Event{Type: EventKick, Occupant: occ, Reason: itemReason(x.Item)})
+	case typ == "unavailable":
+		r.mu.Lock()
+		delete(r.occupants, nick)
+		r.mu.Unlock()
+		r.emit(Event{Type: EventLeave, Occupant: occ})
+	default:
+		r.mu.Lock()
+		r.occupants[nick] = occ
+		r.mu.Unlock()
+		r.emit(Event{Type: EventJoin, Occupant: occ})
+	}
+
+	if isSelf {
+		r.joinOnce.Do(func() { close(r.Joined) })
+	}
+	return nil
+}
+
+func itemReason(i *mucItem) string {
+	if i == nil {
+		return ""
+	}
+	return i.Reason
+}
+
+type messageBody struct {
+	Subject string `xml:"subject"`
+	Body    string `xml:"body"`
+}
+
+func (r *Room) handleMessage(d *xml.Decoder, start xml.StartElement, from *jid.JID) error {
+	parsed := messageBody{}
+	if err := d.DecodeElement(&parsed, &start); err != nil {
+		return err
+	}
+
+	nick := from.Resourcepart()
+	if parsed.Subject != "" {
+		r.mu.Lock()
+		r.subject = parsed.Subject
+		r.mu.Unlock()
+		return nil
+	}
+
+	select {
+	case r.messages <- Message{Nick: nick, Body: parsed.Body}:
+	default:
+	}
+	return nil
+}
+
+// SetSubject requests that the room's subject be changed to subject. Only
+// occupants with a sufficient role are permitted to do this; the room
+// decides whether the change is allowed and echoes the new subject back
+// to every occupant (including the sender) on success.
+func (r *Room) SetSubject(ctx context.Context, subject string) error {
+	return r.sendMessage(subject, true)
+}
+
+// Send sends body as a group-chat message to the room.
+func (r *Room) Send(ctx context.Context, body string) error {
+	return r.sendMessage(body, false)
+}
+
+func (r *Room) sendMessage(text string, subject bool) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "message"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "to"}, Value: r.JID().String()},
+			{Name: xml.Name{Local: "type"}, Value: "groupchat"},
+		},
+	}
+	local := "body"
+	if subject {
+		local = "subject"
+	}
+	if err := r.client.session.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := writeElem(r.client.session, local, text); err != nil {
+		return err
+	}
+	if err := r.client.session.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return r.client.session.Flush()
+}
+
+// Invite asks the room to invite invitee to join, optionally including a
+// reason.
+func (r *Room) Invite(ctx context.Context, invitee *jid.JID, reason string) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "message"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "to"}, Value: r.JID().String()}},
+	}
+	xStart := xml.StartElement{Name: xml.Name{Space: NSUser, Local: "x"}}
+	inviteStart := xml.StartElement{
+		Name: xml.Name{Local: "invite"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "to"}, Value: invitee.String()}},
+	}
+
+	s := r.client.session
+	if err := s.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := s.EncodeToken(xStart); err != nil {
+		return err
+	}
+	if err := s.EncodeToken(inviteStart); err != nil {
+		return err
+	}
+	if reason != "" {
+		if err := writeElem(s, "reason", reason); err != nil {
+			return err
+		}
+	}
+	if err := s.EncodeToken(inviteStart.End()); err != nil {
+		return err
+	}
+	if err := s.EncodeToken(xStart.End()); err != nil {
+		return err
+	}
+	if err := s.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return s.Flush()
+}
+
+// SetRole changes the role of the occupant currently using nick, for
+// example to grant or revoke moderator privileges.
+func (r *Room) SetRole(ctx context.Context, nick string, role Role, reason string) error {
+	return r.setItem(ctx, mucItem{Nick: nick, Role: string(role), Reason: reason})
+}
+
+// SetAffiliation changes j's long-lived affiliation with the room, for
+// example to ban or to grant membership.
+func (r *Room) SetAffiliation(ctx context.Context, j *jid.JID, affiliation Affiliation, reason string) error {
+	return r.setItem(ctx, mucItem{JID: j.String(), Affiliation: string(affiliation), Reason: reason})
+}
+
+func (r *Room) setItem(ctx context.Context, item mucItem) error {
+	iq := stanza.IQ{To: r.JID(), Type: stanza.SetIQ}
+	typ, payload, err := r.client.roundtripIQ(ctx, iq, adminQueryReader(item))
+	if err != nil {
+		return err
+	}
+	if typ == stanza.ErrorIQ {
+		return decodeIQError(payload)
+	}
+	return nil
+}
+
+// decodeIQError decodes the <error/> child of an error IQ response into a
+// stanza.Error, falling back to errNotJoined if payload can't be decoded
+// (for example because the room didn't send one at all).
+func decodeIQError(payload xml.TokenReader) error {
+	stanzaErr := stanza.Error{}
+	if err := xml.NewTokenDecoder(payload).Decode(&stanzaErr); err != nil {
+		return errNotJoined
+	}
+	return stanzaErr
+}
+
+// adminQuery is a minimal, single-use xml.TokenReader that emits a
+// <query xmlns="...#admin"><item .../></query> element for the given item.
+type adminQuery struct {
+	tokens []xml.Token
+}
+
+func adminQueryReader(item mucItem) xml.TokenReader {
+	queryStart := xml.StartElement{Name: xml.Name{Space: NSAdmin, Local: "query"}}
+
+	var attrs []xml.Attr
+	if item.Affiliation != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "affiliation"}, Value: item.Affiliation})
+	}
+	if item.Role != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "role"}, Value: item.Role})
+	}
+	if item.JID != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "jid"}, Value: item.JID})
+	}
+	if item.Nick != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "nick"}, Value: item.Nick})
+	}
+	itemStart := xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs}
+
+	tokens := []xml.Token{queryStart, itemStart}
+	if item.Reason != "" {
+		reasonStart := xml.StartElement{Name: xml.Name{Local: "reason"}}
+		tokens = append(tokens, reasonStart, xml.CharData(item.Reason), reasonStart.End())
+	}
+	tokens = append(tokens, itemStart.End(), queryStart.End())
+
+	return &adminQuery{tokens: tokens}
+}
+
+func (a *adminQuery) Token() (xml.Token, error) {
+	if len(a.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := a.tokens[0]
+	a.tokens = a.tokens[1:]
+	return tok, nil
+}
+
+// configField is a single field of a room's owner configuration form, as
+// defined by XEP-0004 and referenced by XEP-0045 §10.2.
+type configField struct {
+	Var   string `xml:"var,attr"`
+	Value string `xml:"value"`
+}
+
+type configForm struct {
+	XMLName xml.Name      `xml:"jabber:x:data x"`
+	Type    string        `xml:"type,attr"`
+	Field   []configField `xml:"field"`
+}
+
+// Config fetches the room's owner configuration form. The caller is
+// responsible for changing whichever fields it wants to set and passing
+// the result to SetConfig; fields it leaves untouched are resubmitted
+// unchanged.
+func (r *Room) Config(ctx context.Context) (map[string]string, error) {
+	iq := stanza.IQ{To: r.JID(), Type: stanza.GetIQ}
+	typ, payload, err := r.client.roundtripIQ(ctx, iq, ownerQueryReader(nil))
+	if err != nil {
+		return nil, err
+	}
+	if typ == stanza.ErrorIQ {
+		return nil, decodeIQError(payload)
+	}
+
+	parsed := struct {
+		Form configForm `xml:"jabber:x:data x"`
+	}{}
+	if err := xml.NewTokenDecoder(payload).Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(parsed.Form.Field))
+	for _, f := range parsed.Form.Field {
+		fields[f.Var] = f.Value
+	}
+	return fields, nil
+}
+
+// SetConfig submits fields (as returned by a prior call to Config, with any
+// desired changes applied) as the room's new owner configuration.
+func (r *Room) SetConfig(ctx context.Context, fields map[string]string) error {
+	cfgFields := make([]configField, 0, len(fields))
+	for k, v := range fields {
+		cfgFields = append(cfgFields, configField{Var: k, Value: v})
+	}
+
+	iq := stanza.IQ{To: r.JID(), Type: stanza.SetIQ}
+	typ, payload, err := r.client.roundtripIQ(ctx, iq, ownerQueryReader(cfgFields))
+	if err != nil {
+		return err
+	}
+	if typ == stanza.ErrorIQ {
+		return decodeIQError(payload)
+	}
+	return nil
+}
+
+// ownerQuery is a minimal, single-use xml.TokenReader emitting either an
+// empty <query xmlns="...#owner"/> (to request the current configuration
+// form) or one wrapping a submitted jabber:x:data form. The token sequence
+// is built up front, in the same spirit as tokenBuffer in mux.go, rather
+// than computed on the fly.
+type ownerQuery struct {
+	tokens []xml.Token
+}
+
+func ownerQueryReader(fields []configField) xml.TokenReader {
+	queryStart := xml.StartElement{Name: xml.Name{Space: NSOwner, Local: "query"}}
+	q := &ownerQuery{tokens: []xml.Token{queryStart}}
+	if fields == nil {
+		q.tokens = append(q.tokens, queryStart.End())
+		return q
+	}
+
+	xStart := xml.StartElement{
+		Name: xml.Name{Space: "jabber:x:data", Local: "x"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "type"}, Value: "submit"}},
+	}
+	q.tokens = append(q.tokens, xStart)
+	for _, f := range fields {
+		fieldStart := xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "var"}, Value: f.Var}},
+		}
+		valueStart := xml.StartElement{Name: xml.Name{Local: "value"}}
+		q.tokens = append(q.tokens, fieldStart, valueStart, xml.CharData(f.Value), valueStart.End(), fieldStart.End())
+	}
+	q.tokens = append(q.tokens, xStart.End(), queryStart.End())
+	return q
+}
+
+func (q *ownerQuery) Token() (xml.Token, error) {
+	if len(q.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := q.tokens[0]
+	q.tokens = q.tokens[1:]
+	return tok, nil
+}
+
+// Leave sends unavailable presence to the room, optionally with a status
+// message, and stops tracking it.
+func (r *Room) Leave(ctx context.Context, status string) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "presence"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "to"}, Value: r.selfJID().String()},
+			{Name: xml.Name{Local: "type"}, Value: "unavailable"},
+		},
+	}
+	s := r.client.session
+	if err := s.EncodeToken(start); err != nil {
+		return err
+	}
+	if status != "" {
+		if err := writeElem(s, "status", status); err != nil {
+			return err
+		}
+	}
+	if err := s.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	r.client.forget(r.JID())
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package muc
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/jid"
+)
+
+// presenceStart parses s (a single top-level <presence/>) and returns a
+// decoder positioned just after the start tag, along with the start tag
+// itself, as handlePresence expects.
+func presenceStart(t *testing.T, s string) (*xml.Decoder, xml.StartElement) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("did not find a <presence/> start element in %q: %v", s, err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return d, start
+		}
+	}
+}
+
+func testRoom(t *testing.T, selfJID string) *Room {
+	t.Helper()
+	self, err := jid.Parse(selfJID)
+	if err != nil {
+		t.Fatalf("parsing self JID %q: %v", selfJID, err)
+	}
+	return newRoom(nil, self)
+}
+
+func TestHandlePresenceJoin(t *testing.T) {
+	r := testRoom(t, "room@conference.example/me")
+
+	from, err := jid.Parse("room@conference.example/other")
+	if err != nil {
+		t.Fatalf("parsing from JID: %v", err)
+	}
+	d, start := presenceStart(t, `<presence from="room@conference.example/other">
+		<x xmlns="http://jabber.org/protocol/muc#user">
+			<item affiliation="member" role="participant"/>
+		</x>
+	</presence>`)
+	if err := r.handlePresence(d, start, from); err != nil {
+		t.Fatalf("handlePresence: %v", err)
+	}
+
+	occupants := r.Occupants()
+	if len(occupants) != 1 || occupants[0].Nick != "other" {
+		t.Fatalf("got occupants %+v, want a single occupant named other", occupants)
+	}
+	if occupants[0].Role != RoleParticipant || occupants[0].Affiliation != AffiliationMember {
+		t.Errorf("got role=%q affiliation=%q, want participant/member", occupants[0].Role, occupants[0].Affiliation)
+	}
+
+	select {
+	case e := <-r.Events():
+		if e.Type != EventJoin || e.Occupant.Nick != "other" {
+			t.Errorf("got event %+v, want EventJoin for other", e)
+		}
+	default:
+		t.Error("no event emitted for join")
+	}
+}
+
+func TestHandlePresenceLeave(t *testing.T) {
+	r := testRoom(t, "room@conference.example/me")
+	r.occupants["other"] = Occupant{Nick: "other"}
+
+	from, err := jid.Parse("room@conference.example/other")
+	if err != nil {
+		t.Fatalf("parsing from JID: %v", err)
+	}
+	d, start := presenceStart(t, `<presence from="room@conference.example/other" type="unavailable">
+		<x xmlns="http://jabber.org/protocol/muc#user"/>
+	</presence>`)
+	if err := r.handlePresence(d, start, from); err != nil {
+		t.Fatalf("handlePresence: %v", err)
+	}
+
+	if len(r.Occupants()) != 0 {
+		t.Errorf("got occupants %+v, want none after leave", r.Occupants())
+	}
+	select {
+	case e := <-r.Events():
+		if e.Type != EventLeave {
+			t.Errorf("got event type %v, want EventLeave", e.Type)
+		}
+	default:
+		t.Error("no event emitted for leave")
+	}
+}
+
+func TestHandlePresenceKickAndBan(t *testing.T) {
+	tests := []struct {
+		code int
+		want EventType
+	}{
+		{StatusKicked, EventKick},
+		{StatusBanned, EventBan},
+	}
+	for _, tc := range tests {
+		r := testRoom(t, "room@conference.example/me")
+		r.occupants["other"] = Occupant{Nick: "other"}
+
+		from, err := jid.Parse("room@conference.example/other")
+		if err != nil {
+			t.Fatalf("parsing from JID: %v", err)
+		}
+		d, start := presenceStart(t, `<presence from="room@conference.example/other" type="unavailable">
+			<x xmlns="http://jabber.org/protocol/muc#user">
+				<item/>
+				<status code="`+strconv.Itoa(tc.code)+`"/>
+			</x>
+		</presence>`)
+		if err := r.handlePresence(d, start, from); err != nil {
+			t.Fatalf("handlePresence: %v", err)
+		}
+
+		if len(r.Occupants()) != 0 {
+			t.Errorf("code %d: got occupants %+v, want none", tc.code, r.Occupants())
+		}
+		select {
+		case e := <-r.Events():
+			if e.Type != tc.want {
+				t.Errorf("code %d: got event type %v, want %v", tc.code, e.Type, tc.want)
+			}
+		default:
+			t.Errorf("code %d: no event emitted", tc.code)
+		}
+	}
+}
+
+func TestHandlePresenceNickChange(t *testing.T) {
+	r := testRoom(t, "room@conference.example/me")
+	r.occupants["me"] = Occupant{Nick: "me"}
+
+	from, err := jid.Parse("room@conference.example/me")
+	if err != nil {
+		t.Fatalf("parsing from JID: %v", err)
+	}
+	d, start := presenceStart(t, `<presence from="room@conference.example/me" type="unavailable">
+		<x xmlns="http://jabber.org/protocol/muc#user">
+			<item nick="newme"/>
+			<status code="303"/>
+		</x>
+	</presence>`)
+	if err := r.handlePresence(d, start, from); err != nil {
+		t.Fatalf("handlePresence: %v", err)
+	}
+
+	if r.Nick() != "newme" {
+		t.Errorf("got nick %q, want newme", r.Nick())
+	}
+	occupants := r.Occupants()
+	if len(occupants) != 1 || occupants[0].Nick != "newme" {
+		t.Fatalf("got occupants %+v, want a single occupant named newme", occupants)
+	}
+
+	select {
+	case e := <-r.Events():
+		if e.Type != EventNickChange || e.OldNick != "me" || e.Occupant.Nick != "newme" {
+			t.Errorf("got event %+v, want EventNickChange old=me new=newme", e)
+		}
+	default:
+		t.Error("no event emitted for nick change")
+	}
+}
+
+func TestHandlePresenceJoinError(t *testing.T) {
+	r := testRoom(t, "room@conference.example/me")
+
+	from, err := jid.Parse("room@conference.example/me")
+	if err != nil {
+		t.Fatalf("parsing from JID: %v", err)
+	}
+	d, start := presenceStart(t, `<presence from="room@conference.example/me" type="error">
+		<error type="cancel"><conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error>
+	</presence>`)
+	if err := r.handlePresence(d, start, from); err != nil {
+		t.Fatalf("handlePresence: %v", err)
+	}
+
+	if len(r.Occupants()) != 0 {
+		t.Errorf("got occupants %+v, want none after a failed join", r.Occupants())
+	}
+	select {
+	case <-r.Joined:
+		t.Error("Joined was closed on a failed join")
+	default:
+	}
+
+	select {
+	case e := <-r.Events():
+		if e.Type != EventJoinError || e.Err == nil {
+			t.Errorf("got event %+v, want EventJoinError with Err set", e)
+		}
+	default:
+		t.Error("no event emitted for failed join")
+	}
+}
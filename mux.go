@@ -0,0 +1,301 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// IQHandler responds to an inbound IQ stanza whose child element matches
+// the name (namespace and local name) it was registered under with
+// HandleIQ.
+//
+// If the returned payload is non-nil, it is wrapped in an IQ of type
+// "result" addressed back to the original sender and written out; if it is
+// nil, no response is sent (the handler is assumed to have written one
+// itself, or none is required).
+type IQHandler interface {
+	HandleIQ(ctx context.Context, iq stanza.IQ, payload xml.TokenReader) (xml.TokenReader, error)
+}
+
+// IQHandlerFunc is an adapter that allows an ordinary function to be used
+// as an IQHandler.
+type IQHandlerFunc func(ctx context.Context, iq stanza.IQ, payload xml.TokenReader) (xml.TokenReader, error)
+
+// HandleIQ implements IQHandler.
+func (f IQHandlerFunc) HandleIQ(ctx context.Context, iq stanza.IQ, payload xml.TokenReader) (xml.TokenReader, error) {
+	return f(ctx, iq, payload)
+}
+
+// Response is the result of an IQ sent with SendIQ.
+type Response struct {
+	// IQ is the header of the response stanza. Its Type is either
+	// stanza.ResultIQ or stanza.ErrorIQ.
+	IQ stanza.IQ
+
+	// Payload contains the tokens of the response's child element (the
+	// requested data on a result, or a <error/> element on an error). It is
+	// nil if Err is set; if the response carried no child element it is a
+	// non-nil reader that yields no elements.
+	Payload xml.TokenReader
+
+	// Err is set instead of IQ and Payload when no response was ever
+	// received, for example because the context passed to SendIQ was
+	// canceled first.
+	Err error
+}
+
+// IQMux routes inbound IQ stanzas to registered IQHandlers by the name
+// (namespace and local name) of their child element, and correlates IQs sent with SendIQ to the
+// eventual response by id.
+//
+// An IQMux has nothing to dispatch to unless something feeds it inbound
+// stanzas by calling Dispatch for every top-level <iq/> read from the
+// stream. Session.DispatchIQ does exactly that for the mux a Session
+// lazily creates the first time SendIQ or HandleIQ is called on it, and is
+// what the session's background read loop calls for every inbound <iq/>.
+// Negotiate funcs that run before that read loop exists (bind, ibr2) drive
+// their own token loop instead, but call Session.DispatchIQ from it so
+// they still share the same router as everything else.
+//
+// An IQMux is safe for concurrent use.
+type IQMux struct {
+	mu       sync.Mutex
+	handlers map[xml.Name]IQHandler
+	pending  map[string]*pendingIQ
+}
+
+// pendingIQ is the bookkeeping SendIQ registers while it waits for a
+// response to arrive.
+type pendingIQ struct {
+	ch chan Response
+
+	// done is closed by Dispatch once it has delivered (or would have
+	// delivered, had anything still been listening) the response for this
+	// id, so that the goroutine SendIQ starts to watch for ctx cancellation
+	// can stop waiting without requiring ctx itself to ever be canceled.
+	done chan struct{}
+}
+
+// NewIQMux returns an empty, ready to use IQMux.
+func NewIQMux() *IQMux {
+	return &IQMux{
+		handlers: make(map[xml.Name]IQHandler),
+		pending:  make(map[string]*pendingIQ),
+	}
+}
+
+// HandleIQ registers h to handle inbound IQs whose child element has the
+// given name, replacing any handler previously registered for it. Both the
+// namespace and the local name of ns must match the child element.
+func (m *IQMux) HandleIQ(ns xml.Name, h IQHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[ns] = h
+}
+
+// nextIDLocked returns a random id not already associated with a pending
+// IQ. m.mu must already be held by the caller.
+func (m *IQMux) nextIDLocked() string {
+	for {
+		id := internal.RandomID(16)
+		if _, ok := m.pending[id]; !ok {
+			return id
+		}
+	}
+}
+
+// SendIQ writes iq (with payload as its only child) to w, allocating an id
+// for it if one isn't already set, and returns a channel on which the
+// response will be delivered.
+//
+// Exactly one Response is ever sent on the returned channel, after which it
+// is closed: either the genuine response, once it reaches Dispatch, or a
+// Response with Err set to ctx's error if ctx is canceled first. Callers
+// must arrange for Dispatch to be called on every inbound <iq/> (normally
+// from the session read loop) or the response will never arrive.
+func (m *IQMux) SendIQ(ctx context.Context, w xmlstream.TokenWriter, iq stanza.IQ, payload xml.TokenReader) (<-chan Response, error) {
+	p := &pendingIQ{
+		ch:   make(chan Response, 1),
+		done: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if iq.ID == "" {
+		iq.ID = m.nextIDLocked()
+	}
+	m.pending[iq.ID] = p
+	m.mu.Unlock()
+
+	if err := writeIQ(w, iq, payload); err != nil {
+		m.mu.Lock()
+		delete(m.pending, iq.ID)
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-p.done:
+			return
+		case <-ctx.Done():
+		}
+
+		m.mu.Lock()
+		_, ok := m.pending[iq.ID]
+		if ok {
+			delete(m.pending, iq.ID)
+		}
+		m.mu.Unlock()
+		if ok {
+			p.ch <- Response{Err: ctx.Err()}
+			close(p.ch)
+		}
+	}()
+
+	return p.ch, nil
+}
+
+// Dispatch decodes a single inbound <iq/> (whose start tag has already
+// been read from d) and either delivers it to the channel returned by a
+// matching SendIQ call, or looks up a handler for its child element's
+// name and invokes it, writing any handler response back out to w.
+// Per RFC 6120 §8.2.3, every get or set must receive exactly one response;
+// if no handler is registered for one (or it has no child element at all
+// to dispatch on), Dispatch answers it with a service-unavailable error
+// itself instead of leaving the sender to wait forever.
+func (m *IQMux) Dispatch(ctx context.Context, w xmlstream.TokenWriter, d *xml.Decoder, start xml.StartElement) error {
+	hdr := stanza.IQ{
+		ID:   internal.GetAttr(start.Attr, "id"),
+		Type: stanza.IQType(internal.GetAttr(start.Attr, "type")),
+	}
+	if from := internal.GetAttr(start.Attr, "from"); from != "" {
+		hdr.From, _ = jid.Parse(from)
+	}
+	if to := internal.GetAttr(start.Attr, "to"); to != "" {
+		hdr.To, _ = jid.Parse(to)
+	}
+
+	payload, err := bufferChild(d)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Type == stanza.ResultIQ || hdr.Type == stanza.ErrorIQ {
+		m.mu.Lock()
+		p, ok := m.pending[hdr.ID]
+		if ok {
+			delete(m.pending, hdr.ID)
+		}
+		m.mu.Unlock()
+		if ok {
+			p.ch <- Response{IQ: hdr, Payload: payload}
+			close(p.ch)
+			close(p.done)
+		}
+		return nil
+	}
+
+	ns, ok := payload.name()
+	var h IQHandler
+	if ok {
+		m.mu.Lock()
+		h, ok = m.handlers[ns]
+		m.mu.Unlock()
+	}
+	if !ok {
+		stanzaErr := stanza.Error{Condition: stanza.ServiceUnavailable}
+		return writeIQ(w, stanza.IQ{ID: hdr.ID, To: hdr.From, Type: stanza.ErrorIQ}, stanzaErr.TokenReader())
+	}
+
+	resp, err := h.HandleIQ(ctx, hdr, payload)
+	if err != nil || resp == nil {
+		return err
+	}
+	return writeIQ(w, stanza.IQ{ID: hdr.ID, To: hdr.From, Type: stanza.ResultIQ}, resp)
+}
+
+// writeIQ writes iq, with payload as its only child, to w and flushes it.
+// The id attribute is added to the <iq/> start element so that the reply
+// can be correlated with it.
+func writeIQ(w xmlstream.TokenWriter, iq stanza.IQ, payload xml.TokenReader) (err error) {
+	r := stanza.WrapIQ(iq.To, iq.Type, payload)
+	first := true
+	withID := xmlstream.ReaderFunc(func() (xml.Token, error) {
+		tok, err := r.Token()
+		if start, ok := tok.(xml.StartElement); ok && first {
+			first = false
+			attrs := start.Attr[:len(start.Attr):len(start.Attr)]
+			start.Attr = append(attrs, xml.Attr{Name: xml.Name{Local: "id"}, Value: iq.ID})
+			tok = start
+		}
+		return tok, err
+	})
+	if err = xmlstream.Copy(w, withID); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// tokenBuffer is an in-memory xml.TokenReader over the already-decoded
+// children of an element, used so that the payload of an <iq/> can be
+// handed to a handler (or to a waiting SendIQ caller) without being
+// invalidated by the next read from the underlying decoder.
+type tokenBuffer struct {
+	tokens []xml.Token
+	start  *xml.StartElement
+}
+
+func (b *tokenBuffer) Token() (xml.Token, error) {
+	if len(b.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := b.tokens[0]
+	b.tokens = b.tokens[1:]
+	return tok, nil
+}
+
+func (b *tokenBuffer) name() (xml.Name, bool) {
+	if b.start == nil {
+		return xml.Name{}, false
+	}
+	return b.start.Name, true
+}
+
+// bufferChild reads tokens from d until the end element matching the most
+// recently read start element (the enclosing <iq/>) and returns them as a
+// replayable xml.TokenReader.
+func bufferChild(d *xml.Decoder) (*tokenBuffer, error) {
+	buf := &tokenBuffer{}
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		tok = xml.CopyToken(tok)
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 && buf.start == nil {
+				buf.start = &t
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth < 0 {
+				return buf, nil
+			}
+		}
+		buf.tokens = append(buf.tokens, tok)
+	}
+}
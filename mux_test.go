@@ -0,0 +1,175 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package xmpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/stanza"
+)
+
+// testWriter is a minimal xmlstream.TokenWriter that records every token
+// written to it, so that a test can assert on what Dispatch wrote back.
+type testWriter struct {
+	tokens []xml.Token
+}
+
+func (w *testWriter) EncodeToken(t xml.Token) error {
+	w.tokens = append(w.tokens, xml.CopyToken(t))
+	return nil
+}
+
+func (w *testWriter) Flush() error { return nil }
+
+// emptyReader is an xml.TokenReader with no tokens, used as a payload when
+// a test doesn't care about the contents of the IQ.
+type emptyReader struct{}
+
+func (emptyReader) Token() (xml.Token, error) { return nil, io.EOF }
+
+// iqStart parses s (a single top-level <iq/>) and returns a decoder
+// positioned just after the start tag, along with the start tag itself, as
+// Dispatch expects.
+func iqStart(t *testing.T, s string) (*xml.Decoder, xml.StartElement) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			t.Fatalf("did not find an <iq/> start element in %q: %v", s, err)
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return d, start
+		}
+	}
+}
+
+func TestDispatchOutOfOrder(t *testing.T) {
+	m := NewIQMux()
+	w := &testWriter{}
+
+	chA, err := m.SendIQ(context.Background(), w, stanza.IQ{ID: "a", Type: stanza.GetIQ}, emptyReader{})
+	if err != nil {
+		t.Fatalf("SendIQ a: %v", err)
+	}
+	chB, err := m.SendIQ(context.Background(), w, stanza.IQ{ID: "b", Type: stanza.GetIQ}, emptyReader{})
+	if err != nil {
+		t.Fatalf("SendIQ b: %v", err)
+	}
+
+	// Dispatch the response to "b" before the response to "a" arrives.
+	d, start := iqStart(t, `<iq type="result" id="b"></iq>`)
+	if err := m.Dispatch(context.Background(), w, d, start); err != nil {
+		t.Fatalf("Dispatch b: %v", err)
+	}
+	d, start = iqStart(t, `<iq type="result" id="a"></iq>`)
+	if err := m.Dispatch(context.Background(), w, d, start); err != nil {
+		t.Fatalf("Dispatch a: %v", err)
+	}
+
+	respB := <-chB
+	if respB.Err != nil || respB.IQ.ID != "b" {
+		t.Errorf("chB got %+v, want id=b, err=nil", respB)
+	}
+	respA := <-chA
+	if respA.Err != nil || respA.IQ.ID != "a" {
+		t.Errorf("chA got %+v, want id=a, err=nil", respA)
+	}
+}
+
+func TestDispatchUnsolicitedResult(t *testing.T) {
+	m := NewIQMux()
+	w := &testWriter{}
+
+	// A result/error IQ with no matching SendIQ call (for example a stray
+	// retransmit, or a response that arrived after its context was already
+	// canceled and the channel cleaned up) should be dropped, not panic or
+	// block.
+	d, start := iqStart(t, `<iq type="result" id="never-sent"></iq>`)
+	if err := m.Dispatch(context.Background(), w, d, start); err != nil {
+		t.Fatalf("Dispatch unsolicited result: %v", err)
+	}
+	if len(w.tokens) != 0 {
+		t.Errorf("unsolicited result triggered a write: %v", w.tokens)
+	}
+}
+
+// encodeTokens re-encodes tokens as XML text so a test can parse Dispatch's
+// output back out with the standard decoder.
+func encodeTokens(t *testing.T, tokens []xml.Token) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	for _, tok := range tokens {
+		if err := e.EncodeToken(tok); err != nil {
+			t.Fatalf("encoding token %v: %v", tok, err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("flushing encoder: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDispatchUnhandledGet(t *testing.T) {
+	m := NewIQMux()
+	w := &testWriter{}
+
+	// A get/set IQ for which no handler is registered must still get
+	// exactly one response, per RFC 6120 §8.2.3 — silently dropping it
+	// leaves the sender waiting forever.
+	d, start := iqStart(t, `<iq type="get" id="1"><ping xmlns="urn:xmpp:ping"/></iq>`)
+	if err := m.Dispatch(context.Background(), w, d, start); err != nil {
+		t.Fatalf("Dispatch unhandled get: %v", err)
+	}
+
+	resp, start := iqStart(t, string(encodeTokens(t, w.tokens)))
+	iq := struct {
+		Type  string `xml:"type,attr"`
+		ID    string `xml:"id,attr"`
+		Error struct {
+			ServiceUnavailable *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-stanzas service-unavailable"`
+		} `xml:"error"`
+	}{}
+	if err := resp.DecodeElement(&iq, &start); err != nil {
+		t.Fatalf("decoding response to unhandled get: %v", err)
+	}
+	if iq.Type != "error" || iq.ID != "1" {
+		t.Errorf("got type=%q id=%q, want type=error id=1", iq.Type, iq.ID)
+	}
+	if iq.Error.ServiceUnavailable == nil {
+		t.Errorf("response did not contain a service-unavailable condition: %+v", w.tokens)
+	}
+}
+
+func TestSendIQContextCancel(t *testing.T) {
+	m := NewIQMux()
+	w := &testWriter{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := m.SendIQ(ctx, w, stanza.IQ{ID: "cancelme", Type: stanza.GetIQ}, emptyReader{})
+	if err != nil {
+		t.Fatalf("SendIQ: %v", err)
+	}
+	cancel()
+
+	resp := <-ch
+	if resp.Err != context.Canceled {
+		t.Errorf("got err %v, want context.Canceled", resp.Err)
+	}
+
+	// Now that the context has been canceled, Dispatch should find nothing
+	// pending for this id and drop the response rather than panicking on a
+	// closed channel.
+	d, start := iqStart(t, `<iq type="result" id="cancelme"></iq>`)
+	if err := m.Dispatch(context.Background(), w, d, start); err != nil {
+		t.Fatalf("Dispatch after cancel: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package xmpp
+
+import (
+	"mellium.im/xmpp/jid"
+)
+
+// SetOrigin updates the JID that the session believes it is identified by.
+//
+// It is exported so that stream features defined outside of this package
+// (such as resource binding replacements, or in-band registration) can
+// rebind the session's JID once a new identity has been negotiated with the
+// server.
+func (s *Session) SetOrigin(j *jid.JID) {
+	s.origin = j
+}
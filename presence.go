@@ -0,0 +1,190 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package xmpp
+
+import (
+	"encoding/xml"
+
+	"mellium.im/xmpp/jid"
+)
+
+// Presence is an XMPP stanza that advertises or requests information about
+// the network availability of a particular entity. It is used both to
+// broadcast availability (and update it with status or priority
+// information) and, together with the subscription-related presenceType
+// values, to negotiate and maintain presence subscriptions between two
+// entities as described in RFC 6121.
+type Presence struct {
+	stanza
+
+	XMLName xml.Name `xml:"presence"`
+	typ     presenceType
+
+	// Show contains additional availability information such as "away" or
+	// "dnd" and is only meaningful when the presence is of type
+	// AvailablePresence.
+	Show Show `xml:"show,omitempty"`
+
+	// Status is a natural-language description of an entity's availability,
+	// intended for presentation to a human (eg. "Gone to lunch").
+	Status string `xml:"status,omitempty"`
+
+	// Priority indicates the relative priority of a resource when multiple
+	// resources are available for the same bare JID, as described in RFC
+	// 6121 §4.7.2.3.
+	Priority int8 `xml:"priority,omitempty"`
+}
+
+// NewPresence creates a Presence of the given type addressed to to. The
+// zero value of to may be nil, in which case no "to" attribute is written
+// and the stanza is addressed implicitly (eg. to the server, or broadcast
+// to every subscriber).
+func NewPresence(typ presenceType, to *jid.JID) Presence {
+	return Presence{
+		stanza: stanza{To: to},
+		typ:    typ,
+	}
+}
+
+// Type returns the presence's type, or AvailablePresence if none was set.
+func (p Presence) Type() presenceType {
+	return p.typ
+}
+
+// presenceXML is the wire representation of a Presence; it exists so that
+// the unexported typ field can be mapped to the "type" attribute without
+// exposing presenceType as part of the Presence struct itself.
+type presenceXML struct {
+	stanza
+	XMLName  xml.Name `xml:"presence"`
+	Type     string   `xml:"type,attr,omitempty"`
+	Show     Show     `xml:"show,omitempty"`
+	Status   string   `xml:"status,omitempty"`
+	Priority int8     `xml:"priority,omitempty"`
+}
+
+// MarshalXML implements xml.Marshaler.
+func (p Presence) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	x := presenceXML{
+		stanza:   p.stanza,
+		XMLName:  xml.Name{Local: "presence"},
+		Type:     p.typ.String(),
+		Show:     p.Show,
+		Status:   p.Status,
+		Priority: p.Priority,
+	}
+	return e.EncodeElement(x, start)
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (p *Presence) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	x := presenceXML{}
+	if err := d.DecodeElement(&x, &start); err != nil {
+		return err
+	}
+	p.stanza = x.stanza
+	p.XMLName = x.XMLName
+	p.Show = x.Show
+	p.Status = x.Status
+	p.Priority = x.Priority
+	p.typ = parsePresenceType(x.Type)
+	return nil
+}
+
+// Show represents the particular availability sub-state advertised by a
+// Presence, such as "away" or "dnd". It has no meaning unless the presence
+// type is AvailablePresence.
+type Show string
+
+// Pre-defined show values as described in RFC 6121 §4.7.2.1.
+const (
+	ShowChat Show = "chat"
+	ShowAway Show = "away"
+	ShowXA   Show = "xa"
+	ShowDND  Show = "dnd"
+)
+
+type presenceType int
+
+const (
+	// AvailablePresence indicates that the sending entity is available for
+	// communication and is the default presence type; unlike the other types
+	// it has no wire representation (the "type" attribute is omitted
+	// entirely).
+	AvailablePresence presenceType = iota
+
+	// UnavailablePresence indicates that the sending entity is no longer
+	// available for communication, for example when an entity is about to
+	// go offline.
+	UnavailablePresence
+
+	// SubscribePresence is sent by an entity that wishes to subscribe to
+	// another entity's presence.
+	SubscribePresence
+
+	// SubscribedPresence is sent to inform an entity that it has been granted
+	// a subscription to the sender's presence, either because it asked for
+	// one or because the subscription was granted unsolicited.
+	SubscribedPresence
+
+	// UnsubscribePresence is sent by an entity that wishes to unsubscribe
+	// from another entity's presence.
+	UnsubscribePresence
+
+	// UnsubscribedPresence is sent to inform an entity that an existing
+	// subscription has been cancelled, or that a subscription request has
+	// been denied.
+	UnsubscribedPresence
+
+	// ProbePresence is sent by a server on behalf of an entity to request the
+	// current presence of another entity.
+	ProbePresence
+
+	// An ErrorPresence is generated by an entity that experiences an error
+	// when processing presence received from another entity.
+	ErrorPresence
+)
+
+// String returns the wire representation of the presence type, or the empty
+// string for AvailablePresence which has no "type" attribute.
+func (t presenceType) String() string {
+	switch t {
+	case UnavailablePresence:
+		return "unavailable"
+	case SubscribePresence:
+		return "subscribe"
+	case SubscribedPresence:
+		return "subscribed"
+	case UnsubscribePresence:
+		return "unsubscribe"
+	case UnsubscribedPresence:
+		return "unsubscribed"
+	case ProbePresence:
+		return "probe"
+	case ErrorPresence:
+		return "error"
+	}
+	return ""
+}
+
+func parsePresenceType(s string) presenceType {
+	switch s {
+	case "unavailable":
+		return UnavailablePresence
+	case "subscribe":
+		return SubscribePresence
+	case "subscribed":
+		return SubscribedPresence
+	case "unsubscribe":
+		return UnsubscribePresence
+	case "unsubscribed":
+		return UnsubscribedPresence
+	case "probe":
+		return ProbePresence
+	case "error":
+		return ErrorPresence
+	}
+	return AvailablePresence
+}
@@ -0,0 +1,352 @@
+// Copyright 2018 Sam Whited.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package roster implements contact and presence-subscription management as
+// described in RFC 6121.
+package roster // import "mellium.im/xmpp/roster"
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by roster IQs, as defined in RFC 6121.
+const NS = "jabber:iq:roster"
+
+// Subscription describes the state of a presence subscription between the
+// user and a contact.
+type Subscription int
+
+// Subscription states as described in RFC 6121 §2.1.2.
+const (
+	// None indicates that no subscription exists in either direction.
+	None Subscription = iota
+
+	// To indicates that the user has a subscription to the contact's
+	// presence, but not vice versa.
+	To
+
+	// From indicates that the contact has a subscription to the user's
+	// presence, but not vice versa.
+	From
+
+	// Both indicates that the user and the contact are subscribed to each
+	// other's presence.
+	Both
+)
+
+// String implements fmt.Stringer.
+func (s Subscription) String() string {
+	switch s {
+	case To:
+		return "to"
+	case From:
+		return "from"
+	case Both:
+		return "both"
+	}
+	return "none"
+}
+
+// Item represents a single contact in the roster.
+type Item struct {
+	JID          *jid.JID
+	Name         string
+	Subscription Subscription
+
+	// Ask is true if the user has sent a subscription request to this
+	// contact that has not yet been approved or denied (a "pending out"
+	// request).
+	Ask bool
+
+	// PendingIn is true if this contact has requested a subscription to the
+	// user's presence that has not yet been approved or denied. It is
+	// tracked locally for UI approval and is not part of the roster item as
+	// stored on the server.
+	PendingIn bool
+
+	Group []string
+}
+
+type itemXML struct {
+	JID          string   `xml:"jid,attr"`
+	Name         string   `xml:"name,attr,omitempty"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Ask          string   `xml:"ask,attr,omitempty"`
+	Group        []string `xml:"group,omitempty"`
+}
+
+type rosterIQ struct {
+	XMLName xml.Name  `xml:"jabber:iq:roster query"`
+	Ver     string    `xml:"ver,attr,omitempty"`
+	Item    []itemXML `xml:"item"`
+}
+
+// List caches the roster as last synced with the server.
+//
+// A List is safe for concurrent use.
+type List struct {
+	mu      sync.RWMutex
+	items   map[string]Item
+	ver     string
+	updates chan Item
+}
+
+// New creates an empty roster List. Updates delivered to the List (either
+// from a server push or from the subscription handshake carried out by
+// HandlePresence) are published on the channel returned by Updates.
+func New() *List {
+	return &List{
+		items:   make(map[string]Item),
+		updates: make(chan Item, 32),
+	}
+}
+
+// Updates returns a channel on which roster changes are published. Updates
+// are sent without blocking: when the channel's buffer is full, the update
+// is dropped.
+func (l *List) Updates() <-chan Item {
+	return l.updates
+}
+
+// Items returns a snapshot of the current roster.
+func (l *List) Items() []Item {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	items := make([]Item, 0, len(l.items))
+	for _, item := range l.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+func (l *List) set(item Item) {
+	l.mu.Lock()
+	l.items[item.JID.Bare().String()] = item
+	l.mu.Unlock()
+
+	select {
+	case l.updates <- item:
+	default:
+		// Drop the update if nobody is listening so that the subscription
+		// handshake never blocks on a slow, or absent, consumer.
+	}
+}
+
+func (l *List) get(j *jid.JID) (Item, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	item, ok := l.items[j.Bare().String()]
+	return item, ok
+}
+
+// Fetch requests the full roster from the server and replaces the List's
+// contents with the result, correlating the request and response through
+// the session's IQMux rather than reading the stream itself, so concurrent
+// calls to Fetch (and any other traffic on s) don't race over who reads
+// the connection next. If ctx is canceled or its deadline expires before a
+// response arrives, Fetch returns ctx.Err().
+func (l *List) Fetch(ctx context.Context, s *xmpp.Session) error {
+	respChan, err := s.SendIQ(ctx, stanza.IQ{Type: stanza.GetIQ}, queryReader())
+	if err != nil {
+		return err
+	}
+
+	resp := <-respChan
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.IQ.Type == stanza.ErrorIQ {
+		stanzaErr := stanza.Error{}
+		if err := xml.NewTokenDecoder(resp.Payload).Decode(&stanzaErr); err != nil {
+			return err
+		}
+		return stanzaErr
+	}
+
+	q := rosterIQ{}
+	if err := xml.NewTokenDecoder(resp.Payload).Decode(&q); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.items = make(map[string]Item)
+	l.mu.Unlock()
+	l.replace(q)
+	return nil
+}
+
+// rosterQuery is a minimal, single-use xml.TokenReader that emits an empty
+// <query xmlns="jabber:iq:roster"/> element, the payload of a roster fetch
+// request.
+type rosterQuery struct {
+	tokens []xml.Token
+}
+
+func queryReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}}
+	return &rosterQuery{tokens: []xml.Token{start, start.End()}}
+}
+
+func (q *rosterQuery) Token() (xml.Token, error) {
+	if len(q.tokens) == 0 {
+		return nil, io.EOF
+	}
+	tok := q.tokens[0]
+	q.tokens = q.tokens[1:]
+	return tok, nil
+}
+
+func (l *List) replace(q rosterIQ) {
+	l.mu.Lock()
+	l.ver = q.Ver
+	l.mu.Unlock()
+
+	for _, x := range q.Item {
+		item, err := itemFromXML(x)
+		if err != nil {
+			continue
+		}
+		l.set(item)
+	}
+}
+
+// HandlePush updates the local roster in response to a jabber:iq:roster
+// push IQ sent by the server and returns the IQ result that should be sent
+// back to acknowledge it.
+func (l *List) HandlePush(iq stanza.IQ, q rosterIQ) stanza.IQ {
+	l.replace(q)
+	return stanza.IQ{
+		ID:   iq.ID,
+		To:   iq.From,
+		Type: stanza.ResultIQ,
+	}
+}
+
+func itemFromXML(x itemXML) (Item, error) {
+	j, err := jid.Parse(x.JID)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{
+		JID:   j,
+		Name:  x.Name,
+		Group: x.Group,
+		Ask:   x.Ask == "subscribe",
+	}
+	switch x.Subscription {
+	case "to":
+		item.Subscription = To
+	case "from":
+		item.Subscription = From
+	case "both":
+		item.Subscription = Both
+	}
+	return item, nil
+}
+
+// HandlePresence drives the RFC 6121 §3 subscription handshake: it records
+// pending inbound requests, auto-replies to probes from entities that are
+// already subscribed, and updates the cached roster entry's subscription
+// state when a subscribed/unsubscribed notice arrives. It returns any
+// presence stanza that should be sent in response, or nil if no response is
+// required.
+func (l *List) HandlePresence(p xmpp.Presence) *xmpp.Presence {
+	from := p.From
+	if from == nil {
+		return nil
+	}
+
+	switch p.Type() {
+	case xmpp.SubscribePresence:
+		item, ok := l.get(from)
+		if ok && (item.Subscription == From || item.Subscription == Both) {
+			// Already subscribed; ack immediately instead of waiting on the
+			// user.
+			resp := xmpp.NewPresence(xmpp.SubscribedPresence, from)
+			return &resp
+		}
+		item.JID = from.Bare()
+		item.PendingIn = true
+		l.set(item)
+		return nil
+	case xmpp.SubscribedPresence:
+		item, _ := l.get(from)
+		item.JID = from.Bare()
+		if item.Subscription == From || item.Subscription == Both {
+			item.Subscription = Both
+		} else {
+			item.Subscription = To
+		}
+		item.Ask = false
+		l.set(item)
+		return nil
+	case xmpp.UnsubscribePresence:
+		item, _ := l.get(from)
+		item.JID = from.Bare()
+		switch item.Subscription {
+		case Both:
+			item.Subscription = To
+		case From:
+			item.Subscription = None
+		}
+		item.PendingIn = false
+		l.set(item)
+		return nil
+	case xmpp.UnsubscribedPresence:
+		item, _ := l.get(from)
+		item.JID = from.Bare()
+		switch item.Subscription {
+		case Both:
+			item.Subscription = From
+		case To:
+			item.Subscription = None
+		}
+		item.Ask = false
+		l.set(item)
+		return nil
+	case xmpp.ProbePresence:
+		item, ok := l.get(from)
+		if ok && (item.Subscription == From || item.Subscription == Both) {
+			resp := xmpp.NewPresence(xmpp.AvailablePresence, from)
+			return &resp
+		}
+		resp := xmpp.NewPresence(xmpp.UnsubscribedPresence, from)
+		return &resp
+	}
+	return nil
+}
+
+// Ask requests a subscription to j's presence, marking the contact as a
+// pending outbound request until a subscribed (or unsubscribed) notice is
+// received.
+func (l *List) Ask(j *jid.JID) xmpp.Presence {
+	item, _ := l.get(j)
+	item.JID = j.Bare()
+	item.Ask = true
+	l.set(item)
+	return xmpp.NewPresence(xmpp.SubscribePresence, j)
+}
+
+// Broadcast returns the initial, directed or broadcast, available presence
+// stanzas that should be sent on session start so that every subscriber is
+// informed that the user is now online.
+func (l *List) Broadcast() []xmpp.Presence {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	presences := make([]xmpp.Presence, 0, len(l.items))
+	for _, item := range l.items {
+		if item.Subscription == From || item.Subscription == Both {
+			presences = append(presences, xmpp.NewPresence(xmpp.AvailablePresence, item.JID))
+		}
+	}
+	return presences
+}